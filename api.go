@@ -0,0 +1,210 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync/atomic"
+
+    "github.com/vishvananda/netlink"
+)
+
+// routeRequest is the body accepted by POST /routes.
+type routeRequest struct {
+    Dst      string `json:"dst"`
+    Outbound string `json:"outbound"`
+}
+
+// runAPIServer starts the embedded management HTTP server and blocks
+// forever, turning the one-shot route loader into a long-running
+// daemon that can be inspected and driven remotely.
+func runAPIServer(config Config, outbounds map[string]Outbound) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/routes", routesHandler(config, outbounds))
+    mux.HandleFunc("/routes/", routeDeleteHandler(config, outbounds))
+    mux.HandleFunc("/reload", reloadHandler(config, outbounds))
+    mux.HandleFunc("/stats", statsHandler)
+
+    if err := http.ListenAndServe(config.APIListen, mux); err != nil {
+        log.Fatalf("\033[31mError starting management API: %v\033[0m", err)
+    }
+}
+
+// outboundFromQuery resolves the ?outbound= query parameter against
+// outbounds, defaulting to "ss" so existing callers that don't pass one
+// keep working unchanged.
+func outboundFromQuery(r *http.Request, outbounds map[string]Outbound) (Outbound, error) {
+    name := r.URL.Query().Get("outbound")
+    if name == "" {
+        name = "ss"
+    }
+
+    outbound, ok := outbounds[name]
+    if !ok {
+        return Outbound{}, fmt.Errorf("unknown outbound %q", name)
+    }
+    return outbound, nil
+}
+
+// routesHandler serves GET /routes (list) and POST /routes (add).
+func routesHandler(config Config, outbounds map[string]Outbound) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet:
+            outbound, err := outboundFromQuery(r, outbounds)
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+
+            iface, err := netlink.LinkByName(outbound.Interface)
+            if err != nil {
+                http.Error(w, fmt.Sprintf("error reading interface %s: %v", outbound.Interface, err), http.StatusInternalServerError)
+                return
+            }
+
+            // Routes for this outbound can come from several producers
+            // (directory sync, GeoIP, the rule engine, domain
+            // resolution, or this very endpoint's POST), each tagged
+            // with its own protocol; list across all of them so the
+            // response reflects everything this tool has installed.
+            var routes []netlink.Route
+            for _, protocol := range toolRouteProtocols {
+                protoRoutes, err := routeListForOutbound(iface, outbound, protocol)
+                if err != nil {
+                    http.Error(w, fmt.Sprintf("error listing routes: %v", err), http.StatusInternalServerError)
+                    return
+                }
+                routes = append(routes, protoRoutes...)
+            }
+
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(routes)
+
+        case http.MethodPost:
+            var req routeRequest
+            if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+                http.Error(w, fmt.Sprintf("error decoding request: %v", err), http.StatusBadRequest)
+                return
+            }
+
+            outbound, ok := outbounds[req.Outbound]
+            if !ok {
+                http.Error(w, fmt.Sprintf("unknown outbound %q", req.Outbound), http.StatusBadRequest)
+                return
+            }
+
+            if err := addRoute(req.Dst, outbound, routeProtocolAPI); err != nil {
+                atomic.AddInt64(&stats.RoutesFailed, 1)
+                http.Error(w, fmt.Sprintf("error adding route %s: %v", req.Dst, err), http.StatusInternalServerError)
+                return
+            }
+            atomic.AddInt64(&stats.RoutesAdded, 1)
+            w.WriteHeader(http.StatusCreated)
+
+        default:
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        }
+    }
+}
+
+// routeDeleteHandler serves DELETE /routes/{cidr}.
+func routeDeleteHandler(config Config, outbounds map[string]Outbound) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodDelete {
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+
+        cidr, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/routes/"))
+        if err != nil || cidr == "" {
+            http.Error(w, "missing or malformed cidr", http.StatusBadRequest)
+            return
+        }
+
+        outbound, err := outboundFromQuery(r, outbounds)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        iface, err := netlink.LinkByName(outbound.Interface)
+        if err != nil {
+            http.Error(w, fmt.Sprintf("error reading interface %s: %v", outbound.Interface, err), http.StatusInternalServerError)
+            return
+        }
+
+        _, ipNet, err := parseDestination(cidr)
+        if err != nil {
+            http.Error(w, fmt.Sprintf("error parsing cidr %s: %v", cidr, err), http.StatusBadRequest)
+            return
+        }
+
+        // The route could have come from any producer, so try every
+        // protocol this tool tags its own routes with rather than
+        // assuming one; the protocol filter is still what keeps this
+        // from ever matching (and deleting) a kernel route.
+        var lastErr error
+        deleted := false
+        for _, protocol := range toolRouteProtocols {
+            route := &netlink.Route{Dst: ipNet, LinkIndex: iface.Attrs().Index, Table: outbound.TableID, Protocol: netlink.RouteProtocol(protocol)}
+            if err := netlink.RouteDel(route); err == nil {
+                deleted = true
+                break
+            } else {
+                lastErr = err
+            }
+        }
+        if !deleted {
+            http.Error(w, fmt.Sprintf("error deleting route %s: %v", cidr, lastErr), http.StatusNotFound)
+            return
+        }
+
+        w.WriteHeader(http.StatusNoContent)
+    }
+}
+
+// reloadHandler serves POST /reload, re-reading the JSON route
+// directories against the current outbounds. reconcileDir only ever
+// touches routeProtocolSync routes (see routeListForOutbound), so this
+// can't clobber GeoIP, rule-engine, or domain-resolved routes living on
+// the same outbound — it reconciles the directories and nothing else.
+func reloadHandler(config Config, outbounds map[string]Outbound) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodPost {
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+
+        if ss, ok := outbounds["ss"]; ok && ss.Interface != "" && ss.Gateway != "" {
+            if err := reconcileDir("data", ss, config.GoroutineCount); err != nil {
+                log.Printf("\033[31mError reloading data routes: %v\033[0m\n", err)
+            }
+        }
+        if direct, ok := outbounds["direct"]; ok && direct.Interface != "" && direct.Gateway != "" {
+            if err := reconcileDir("default_route", direct, config.GoroutineCount); err != nil {
+                log.Printf("\033[31mError reloading default routes: %v\033[0m\n", err)
+            }
+        }
+
+        w.WriteHeader(http.StatusNoContent)
+    }
+}
+
+// statsHandler serves GET /stats.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]int64{
+        "routes_added":    atomic.LoadInt64(&stats.RoutesAdded),
+        "routes_failed":   atomic.LoadInt64(&stats.RoutesFailed),
+        "goroutines_busy": atomic.LoadInt64(&stats.GoroutinesBusy),
+    })
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sync"
+)
+
+// CAS is a content-addressable store: every blob it holds is named
+// after the SHA-256 of its own bytes, so repeated fetches of identical
+// content collapse onto the same file.
+type CAS struct {
+    dir string
+}
+
+// NewCAS returns a CAS backed by dir, creating it if necessary.
+func NewCAS(dir string) (*CAS, error) {
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, fmt.Errorf("error creating cache dir %s: %v", dir, err)
+    }
+    return &CAS{dir: dir}, nil
+}
+
+// put stores data under its SHA-256 digest and returns the digest.
+func (c *CAS) put(data []byte) (string, error) {
+    sum := sha256.Sum256(data)
+    digest := hex.EncodeToString(sum[:])
+    dst := filepath.Join(c.dir, digest)
+
+    if _, err := os.Stat(dst); err == nil {
+        return digest, nil
+    }
+
+    tmp, err := ioutil.TempFile(c.dir, "tmp-*")
+    if err != nil {
+        return "", err
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return "", err
+    }
+    if err := tmp.Close(); err != nil {
+        return "", err
+    }
+
+    if err := os.Rename(tmp.Name(), dst); err != nil {
+        return "", err
+    }
+
+    return digest, nil
+}
+
+// pointer records, for a given source tag (e.g. a URL), the ETag it was
+// last fetched with and the digest of the body that ETag produced.
+type pointer struct {
+    ETag   string `json:"etag"`
+    Digest string `json:"digest"`
+}
+
+func (c *CAS) pointerPath(tag string) string {
+    sum := sha256.Sum256([]byte(tag))
+    return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".pointer")
+}
+
+func (c *CAS) readPointer(tag string) pointer {
+    data, err := ioutil.ReadFile(c.pointerPath(tag))
+    if err != nil {
+        return pointer{}
+    }
+    var p pointer
+    if err := json.Unmarshal(data, &p); err != nil {
+        return pointer{}
+    }
+    return p
+}
+
+func (c *CAS) writePointer(tag string, p pointer) error {
+    data, err := json.Marshal(p)
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(c.pointerPath(tag), data, 0o644)
+}
+
+// fetchResult is what a source-specific fetch implementation returns:
+// either fresh body bytes and the ETag that produced them, or
+// Unchanged set when a conditional request confirmed the previous
+// fetch is still current.
+type fetchResult struct {
+    Body      []byte
+    ETag      string
+    Unchanged bool
+}
+
+// GetOrCreate resolves tag (typically a source URL) through the cache.
+// create is invoked with the ETag recorded from the last successful
+// fetch (empty if none); if it reports Unchanged, the previously
+// cached path is reused without re-downloading anything. Otherwise the
+// returned body is stored content-addressably and that path is
+// returned.
+func (c *CAS) GetOrCreate(tag string, create func(prevETag string) (fetchResult, error)) (string, error) {
+    prev := c.readPointer(tag)
+
+    result, err := create(prev.ETag)
+    if err != nil {
+        return "", err
+    }
+
+    if result.Unchanged {
+        if prev.Digest == "" {
+            return "", fmt.Errorf("source %s reported unchanged but nothing is cached for it", tag)
+        }
+        return filepath.Join(c.dir, prev.Digest), nil
+    }
+
+    digest, err := c.put(result.Body)
+    if err != nil {
+        return "", err
+    }
+
+    if err := c.writePointer(tag, pointer{ETag: result.ETag, Digest: digest}); err != nil {
+        return "", err
+    }
+
+    return filepath.Join(c.dir, digest), nil
+}
+
+// fetchURL performs a conditional GET against url, sending
+// If-None-Match when prevETag is set, so an unchanged remote list
+// costs a single round trip and no re-download.
+func fetchURL(url, prevETag string) (fetchResult, error) {
+    req, err := http.NewRequest(http.MethodGet, url, nil)
+    if err != nil {
+        return fetchResult{}, fmt.Errorf("error building request for %s: %v", url, err)
+    }
+    if prevETag != "" {
+        req.Header.Set("If-None-Match", prevETag)
+    }
+
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return fetchResult{}, fmt.Errorf("error fetching %s: %v", url, err)
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusNotModified {
+        return fetchResult{Unchanged: true}, nil
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return fetchResult{}, fmt.Errorf("error fetching %s: unexpected status %s", url, resp.Status)
+    }
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return fetchResult{}, fmt.Errorf("error reading body of %s: %v", url, err)
+    }
+
+    return fetchResult{Body: body, ETag: resp.Header.Get("ETag")}, nil
+}
+
+var (
+    sourceCache     *CAS
+    sourceCacheOnce sync.Once
+    sourceCacheErr  error
+)
+
+// routeSourceCache returns the process-wide CAS used to cache
+// downloaded rule lists, creating it on first use.
+func routeSourceCache() (*CAS, error) {
+    sourceCacheOnce.Do(func() {
+        sourceCache, sourceCacheErr = NewCAS("cache")
+    })
+    return sourceCache, sourceCacheErr
+}
+
+// fetchSource resolves a single source URL to a local, cached file
+// path, fetching it only if the cache doesn't already hold the
+// current version.
+func fetchSource(url string) (string, error) {
+    cache, err := routeSourceCache()
+    if err != nil {
+        return "", err
+    }
+
+    return cache.GetOrCreate(url, func(prevETag string) (fetchResult, error) {
+        return fetchURL(url, prevETag)
+    })
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+    "errors"
+    "os"
+    "testing"
+)
+
+func TestCASPutDedupesIdenticalContent(t *testing.T) {
+    cas, err := NewCAS(t.TempDir())
+    if err != nil {
+        t.Fatalf("NewCAS: unexpected error: %v", err)
+    }
+
+    digest1, err := cas.put([]byte("same bytes"))
+    if err != nil {
+        t.Fatalf("put: unexpected error: %v", err)
+    }
+    digest2, err := cas.put([]byte("same bytes"))
+    if err != nil {
+        t.Fatalf("put: unexpected error: %v", err)
+    }
+    if digest1 != digest2 {
+        t.Fatalf("put returned different digests for identical content: %q vs %q", digest1, digest2)
+    }
+
+    digest3, err := cas.put([]byte("different bytes"))
+    if err != nil {
+        t.Fatalf("put: unexpected error: %v", err)
+    }
+    if digest3 == digest1 {
+        t.Fatalf("put returned the same digest for different content")
+    }
+}
+
+func TestCASGetOrCreateFetchesOnce(t *testing.T) {
+    cas, err := NewCAS(t.TempDir())
+    if err != nil {
+        t.Fatalf("NewCAS: unexpected error: %v", err)
+    }
+
+    calls := 0
+    create := func(prevETag string) (fetchResult, error) {
+        calls++
+        if prevETag != "" {
+            t.Fatalf("expected no prior ETag on first fetch, got %q", prevETag)
+        }
+        return fetchResult{Body: []byte("body v1"), ETag: "etag-v1"}, nil
+    }
+
+    path, err := cas.GetOrCreate("tag", create)
+    if err != nil {
+        t.Fatalf("GetOrCreate: unexpected error: %v", err)
+    }
+    if calls != 1 {
+        t.Fatalf("create called %d times, want 1", calls)
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatalf("error reading cached path %s: %v", path, err)
+    }
+    if string(data) != "body v1" {
+        t.Fatalf("cached body = %q, want %q", data, "body v1")
+    }
+}
+
+func TestCASGetOrCreateReusesUnchangedContent(t *testing.T) {
+    cas, err := NewCAS(t.TempDir())
+    if err != nil {
+        t.Fatalf("NewCAS: unexpected error: %v", err)
+    }
+
+    if _, err := cas.GetOrCreate("tag", func(prevETag string) (fetchResult, error) {
+        return fetchResult{Body: []byte("body v1"), ETag: "etag-v1"}, nil
+    }); err != nil {
+        t.Fatalf("first GetOrCreate: unexpected error: %v", err)
+    }
+
+    var sawETag string
+    path, err := cas.GetOrCreate("tag", func(prevETag string) (fetchResult, error) {
+        sawETag = prevETag
+        return fetchResult{Unchanged: true}, nil
+    })
+    if err != nil {
+        t.Fatalf("second GetOrCreate: unexpected error: %v", err)
+    }
+    if sawETag != "etag-v1" {
+        t.Fatalf("create saw prevETag %q, want %q", sawETag, "etag-v1")
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatalf("error reading cached path %s: %v", path, err)
+    }
+    if string(data) != "body v1" {
+        t.Fatalf("cached body after an unchanged refetch = %q, want %q", data, "body v1")
+    }
+}
+
+func TestCASGetOrCreatePropagatesCreateError(t *testing.T) {
+    cas, err := NewCAS(t.TempDir())
+    if err != nil {
+        t.Fatalf("NewCAS: unexpected error: %v", err)
+    }
+
+    wantErr := errors.New("fetch failed")
+    _, err = cas.GetOrCreate("tag", func(prevETag string) (fetchResult, error) {
+        return fetchResult{}, wantErr
+    })
+    if !errors.Is(err, wantErr) {
+        t.Fatalf("GetOrCreate error = %v, want %v", err, wantErr)
+    }
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "fmt"
+    "log"
+
+    "github.com/oschwald/maxminddb-golang"
+)
+
+// geoipRecord is the subset of a MaxMind Country/City database record we
+// need to make a routing decision.
+type geoipRecord struct {
+    Country struct {
+        ISOCode string `maxminddb:"iso_code"`
+    } `maxminddb:"country"`
+}
+
+// addRoutesFromGeoIP walks every network in a MaxMind .mmdb database and
+// routes the ones matching the configured country set via the given
+// Shadowsocks gateway/interface.
+//
+// If excludeCountries is non-empty, the match is inverted: every network
+// whose country is NOT in that set is routed via SS. countries and
+// excludeCountries are mutually exclusive; if both are set, countries wins.
+func addRoutesFromGeoIP(dbPath string, countries, excludeCountries []string, outbound Outbound, protocol int, gouroutinecount int) error {
+    db, err := maxminddb.Open(dbPath)
+    if err != nil {
+        return fmt.Errorf("error opening GeoIP database %s: %v", dbPath, err)
+    }
+    defer db.Close()
+
+    wanted := make(map[string]struct{}, len(countries))
+    for _, c := range countries {
+        wanted[c] = struct{}{}
+    }
+
+    excluded := make(map[string]struct{}, len(excludeCountries))
+    for _, c := range excludeCountries {
+        excluded[c] = struct{}{}
+    }
+
+    var destinations []string
+    networks := db.Networks()
+    for networks.Next() {
+        var record geoipRecord
+        subnet, err := networks.Network(&record)
+        if err != nil {
+            log.Printf("\033[31mError reading GeoIP network: %v\033[0m\n", err)
+            continue
+        }
+
+        if record.Country.ISOCode == "" {
+            continue
+        }
+
+        if len(wanted) > 0 {
+            if _, ok := wanted[record.Country.ISOCode]; !ok {
+                continue
+            }
+        } else if len(excluded) > 0 {
+            if _, ok := excluded[record.Country.ISOCode]; ok {
+                continue
+            }
+        } else {
+            continue
+        }
+
+        destinations = append(destinations, subnet.String())
+    }
+    if err := networks.Err(); err != nil {
+        return fmt.Errorf("error walking GeoIP database %s: %v", dbPath, err)
+    }
+
+    log.Printf("GeoIP matched %d networks, adding routes\n", len(destinations))
+    addRoutesPool(destinations, outbound, protocol, gouroutinecount)
+
+    return nil
+}
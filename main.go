@@ -2,26 +2,77 @@ package main
 
 import (
     "bufio"
-    "encoding/json"
     "fmt"
-    "io/ioutil"
     "log"
     "net"
     "os"
-    "path/filepath"
     "strings"
     "sync"
+    "sync/atomic"
     "strconv"
+    "time"
 
     "github.com/vishvananda/netlink"
 )
 
+// stats holds process-wide counters exposed over the management API.
+var stats struct {
+    RoutesAdded    int64
+    RoutesFailed   int64
+    GoroutinesBusy int64
+}
+
 type Config struct {
-    Gateway          string
-    Interface        string
-    DefaultGateway   string
-    DefaultInterface string
-    GoroutineCount   int
+    Gateway               string
+    Interface             string
+    DefaultGateway        string
+    DefaultInterface      string
+    GoroutineCount        int
+    GeoIPDB               string
+    GeoIPCountries        []string
+    GeoIPExcludeCountries []string
+    RulesFile             string
+    DomainRefreshInterval int
+    APIListen             string
+    TableID               int
+    FwMark                uint32
+    Family                string
+    RefreshInterval       int
+}
+
+// Routes this tool installs are tagged with a dedicated rtnetlink
+// protocol value (see rtnetlink(7)'s RTPROT_* range), distinct from the
+// kernel's own RTPROT_KERNEL/RTPROT_BOOT routes (the default route,
+// connected subnets, etc.) and from each other. Each producer gets its
+// own value so that, say, reconcileDir's diff against data/'s desired
+// set only ever sees and deletes the routes data/ itself produced,
+// never a GeoIP, rule-engine, domain, or ad-hoc API route living on the
+// same interface/table.
+const (
+    routeProtocolSync   = 200 // data/ and default_route/ directory sync (reconcileDir)
+    routeProtocolGeoIP  = 201 // addRoutesFromGeoIP's flat geoip_countries config
+    routeProtocolRules  = 202 // RuleEngine.InstallRules (IP-CIDR/IP-CIDR6/GEOIP rules)
+    routeProtocolDomain = 203 // RuleEngine's resolved DOMAIN/DOMAIN-SUFFIX rules
+    routeProtocolAPI    = 204 // ad-hoc routes added via POST /routes
+)
+
+// toolRouteProtocols lists every protocol value this tool ever tags a
+// route with, for code that needs to recognize "a route we own" without
+// caring which producer added it (e.g. the management API's route
+// listing and delete-by-CIDR endpoints).
+var toolRouteProtocols = []int{routeProtocolSync, routeProtocolGeoIP, routeProtocolRules, routeProtocolDomain, routeProtocolAPI}
+
+// Outbound describes a nexthop that destinations can be routed through:
+// a gateway IP reachable over a given interface. TableID and FwMark are
+// zero when the outbound should use the main routing table (the
+// system's ordinary default route), and non-zero when it should live
+// in its own policy-routing table instead.
+type Outbound struct {
+    Name      string
+    Gateway   string
+    Interface string
+    TableID   int
+    FwMark    uint32
 }
 
 func readConfig(filename string) (Config, error) {
@@ -58,6 +109,39 @@ func readConfig(filename string) (Config, error) {
 	    if err != nil {
         	panic(err)
 		}
+        case "geoip_db":
+            config.GeoIPDB = value
+        case "geoip_countries":
+            config.GeoIPCountries = splitCSV(value)
+        case "geoip_exclude_countries":
+            config.GeoIPExcludeCountries = splitCSV(value)
+        case "rules_file":
+            config.RulesFile = value
+        case "domain_refresh_interval":
+            config.DomainRefreshInterval, err = strconv.Atoi(value)
+            if err != nil {
+                panic(err)
+            }
+        case "api_listen":
+            config.APIListen = value
+        case "table_id":
+            config.TableID, err = strconv.Atoi(value)
+            if err != nil {
+                panic(err)
+            }
+        case "fwmark":
+            mark, err := strconv.ParseUint(value, 0, 32)
+            if err != nil {
+                panic(err)
+            }
+            config.FwMark = uint32(mark)
+        case "family":
+            config.Family = value
+        case "refresh_interval":
+            config.RefreshInterval, err = strconv.Atoi(value)
+            if err != nil {
+                panic(err)
+            }
         }
     }
 
@@ -68,92 +152,91 @@ func readConfig(filename string) (Config, error) {
     return config, nil
 }
 
-func addRoute(destination, gateway, ifaceName string) error {
-    iface, err := netlink.LinkByName(ifaceName)
+// parseDestination accepts either a CIDR or a bare IP literal and
+// returns the IP plus the network it should be routed as; a bare IP is
+// widened to a single-address network: /32 for IPv4, /128 for IPv6.
+func parseDestination(destination string) (net.IP, *net.IPNet, error) {
+    ip, ipNet, err := net.ParseCIDR(destination)
+    if err == nil {
+        return ip, ipNet, nil
+    }
+
+    ip = net.ParseIP(destination)
+    if ip == nil {
+        return nil, nil, fmt.Errorf("error parsing destination %s: %v", destination, err)
+    }
+
+    bits := 128
+    if ip.To4() != nil {
+        bits = 32
+    }
+    return ip, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func addRoute(destination string, outbound Outbound, protocol int) error {
+    iface, err := netlink.LinkByName(outbound.Interface)
     if err != nil {
-        return fmt.Errorf("error reading interface %s: %v", ifaceName, err)
+        return fmt.Errorf("error reading interface %s: %v", outbound.Interface, err)
     }
 
-    ip, ipNet, err := net.ParseCIDR(destination)
+    _, ipNet, err := parseDestination(destination)
     if err != nil {
-        ip = net.ParseIP(destination)
-        if ip == nil {
-            return fmt.Errorf("error parsing destination %s: %v", destination, err)
-        }
-        ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+        return err
     }
 
     route := &netlink.Route{
         Dst:       ipNet,
-        Gw:        net.ParseIP(gateway),
+        Gw:        net.ParseIP(outbound.Gateway),
         LinkIndex: iface.Attrs().Index,
+        Table:     outbound.TableID,
+        Protocol:  netlink.RouteProtocol(protocol),
     }
 
     if err := netlink.RouteAdd(route); err != nil {
-        return fmt.Errorf("error adding route %s via %s: %v", destination, gateway, err)
+        return fmt.Errorf("error adding route %s via %s: %v", destination, outbound.Gateway, err)
     }
 
     return nil
 }
 
-func addRoutesFromDir(dir, gateway, iface string, gouroutinecount int) error {
-    if _, err := os.Stat(dir); os.IsNotExist(err) {
-        log.Printf("Directory %s does not exist — skipping\n", dir)
-        return nil
-    }
-
-    var jsonFiles []string
-
-    err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-        if err != nil {
-            return err
-        }
-        if !info.IsDir() && filepath.Ext(path) == ".json" {
-            jsonFiles = append(jsonFiles, info.Name())
+// splitCSV splits a comma-separated config value into its trimmed,
+// non-empty parts.
+func splitCSV(value string) []string {
+    var out []string
+    for _, part := range strings.Split(value, ",") {
+        part = strings.TrimSpace(part)
+        if part != "" {
+            out = append(out, part)
         }
-        return nil
-    })
-    if err != nil {
-        return fmt.Errorf("error reading folder %s: %v", dir, err)
     }
+    return out
+}
 
-    if len(jsonFiles) == 0 {
-        log.Printf("No route files found in %s — skipping\n", dir)
-        return nil
-    }
-
-    for _, fileName := range jsonFiles {
-        log.Println("Processing:", fileName)
-        data, err := ioutil.ReadFile(filepath.Join(dir, fileName))
-        if err != nil {
-            log.Printf("\033[31mError reading file %s: %v\033[0m\n", fileName, err)
-            continue
-        }
-
-        var destinations []string
-        if err := json.Unmarshal(data, &destinations); err != nil {
-            log.Printf("\033[31mError parsing JSON %s: %v\033[0m\n", fileName, err)
-            continue
-        }
+// addRoutesPool fans destinations out across a bounded pool of goroutines,
+// each calling addRoute via the given outbound and protocol tag, and
+// waits for all of them to finish.
+func addRoutesPool(destinations []string, outbound Outbound, protocol int, gouroutinecount int) {
+    var wg sync.WaitGroup
+    sem := make(chan struct{}, gouroutinecount)
 
-        var wg sync.WaitGroup
-        sem := make(chan struct{}, gouroutinecount)
-
-        for _, dest := range destinations {
-            wg.Add(1)
-            sem <- struct{}{}
-            go func(d string) {
-                defer wg.Done()
-                defer func() { <-sem }()
-                if err := addRoute(d, gateway, iface); err != nil {
-                    log.Printf("\033[31mError adding route for %s via %s dev %s: %v\033[0m\n", d, gateway, iface, err)
-                }
-            }(dest)
-        }
-
-        wg.Wait()
+    for _, dest := range destinations {
+        wg.Add(1)
+        sem <- struct{}{}
+        go func(d string) {
+            atomic.AddInt64(&stats.GoroutinesBusy, 1)
+            defer atomic.AddInt64(&stats.GoroutinesBusy, -1)
+            defer wg.Done()
+            defer func() { <-sem }()
+            if err := addRoute(d, outbound, protocol); err != nil {
+                log.Printf("\033[31mError adding route for %s via %s dev %s: %v\033[0m\n", d, outbound.Gateway, outbound.Interface, err)
+                atomic.AddInt64(&stats.RoutesFailed, 1)
+                return
+            }
+            atomic.AddInt64(&stats.RoutesAdded, 1)
+        }(dest)
     }
-    return nil
+
+    wg.Wait()
 }
 
 func main() {
@@ -165,18 +248,63 @@ func main() {
     mainDir := "data"
     defaultDir := "default_route"
 
+    ssOutbound := Outbound{Name: "ss", Gateway: config.Gateway, Interface: config.Interface, TableID: config.TableID, FwMark: config.FwMark}
+    directOutbound := Outbound{Name: "direct", Gateway: config.DefaultGateway, Interface: config.DefaultInterface}
+    outbounds := map[string]Outbound{
+        ssOutbound.Name:     ssOutbound,
+        directOutbound.Name: directOutbound,
+    }
+
+    if err := setupPolicyRoutingForOutbounds(outbounds, config.Family); err != nil {
+        log.Printf("\033[31mError setting up policy routing: %v\033[0m\n", err)
+    }
+
+    refreshInterval := time.Duration(config.RefreshInterval) * time.Second
+
     if config.Interface != "" && config.Gateway != "" {
-        log.Println("Adding routes for interface:", config.Interface)
-        if err := addRoutesFromDir(mainDir, config.Gateway, config.Interface, config.GoroutineCount); err != nil {
-            log.Printf("\033[31mError adding routes: %v\033[0m\n", err)
+        log.Println("Syncing routes for interface:", config.Interface)
+        if err := watchDir(mainDir, ssOutbound, config.GoroutineCount, refreshInterval); err != nil {
+            log.Printf("\033[31mError syncing routes: %v\033[0m\n", err)
         }
     }
 
     if config.DefaultInterface != "" && config.DefaultGateway != "" {
-        log.Println("Adding routes for default interface:", config.DefaultInterface)
-        if err := addRoutesFromDir(defaultDir, config.DefaultGateway, config.DefaultInterface, config.GoroutineCount); err != nil {
-            log.Printf("\033[31mError adding default routes: %v\033[0m\n", err)
+        log.Println("Syncing routes for default interface:", config.DefaultInterface)
+        if err := watchDir(defaultDir, directOutbound, config.GoroutineCount, refreshInterval); err != nil {
+            log.Printf("\033[31mError syncing default routes: %v\033[0m\n", err)
+        }
+    }
+
+    if config.GeoIPDB != "" && config.Interface != "" && config.Gateway != "" {
+        log.Println("Adding GeoIP routes from:", config.GeoIPDB)
+        if err := addRoutesFromGeoIP(config.GeoIPDB, config.GeoIPCountries, config.GeoIPExcludeCountries, ssOutbound, routeProtocolGeoIP, config.GoroutineCount); err != nil {
+            log.Printf("\033[31mError adding GeoIP routes: %v\033[0m\n", err)
+        }
+    }
+
+    if config.RulesFile != "" {
+        engine, err := NewRuleEngine(config.RulesFile, outbounds, config.GeoIPDB)
+        if err != nil {
+            log.Printf("\033[31mError loading rules file %s: %v\033[0m\n", config.RulesFile, err)
+        } else {
+            log.Println("Loaded rule engine from:", config.RulesFile)
+            if err := engine.InstallRules(config.GoroutineCount); err != nil {
+                log.Printf("\033[31mError installing rule-matched routes: %v\033[0m\n", err)
+            }
+            refresh := time.Duration(config.DomainRefreshInterval) * time.Second
+            engine.ResolveDomainRules(config.GoroutineCount, refresh)
         }
     }
+
+    if config.APIListen != "" {
+        log.Println("Starting management API on:", config.APIListen)
+        runAPIServer(config, outbounds)
+        return
+    }
+
+    // The directory watchers above run in background goroutines; block
+    // here so the process keeps reconciling routes instead of exiting
+    // right after the initial sync.
+    select {}
 }
 
@@ -0,0 +1,77 @@
+package main
+
+import (
+    "fmt"
+
+    "github.com/vishvananda/netlink"
+)
+
+// rulePriorityBase offsets the `ip rule` priority this tool assigns from
+// a table's ID, keeping every outbound's rule at a deterministic,
+// distinct priority instead of leaving it for the kernel to assign.
+const rulePriorityBase = 10000
+
+// setupPolicyRouting programs an `ip rule` that sends packets carrying
+// outbound's fwmark to its dedicated routing table, so routes installed
+// there (see addRoute's Table field) don't have to fight the system's
+// main table for priority. It is a no-op when the outbound doesn't use
+// a dedicated table.
+//
+// The rule is deleted before it's re-added, so restarting the process
+// re-applies the same rule instead of failing with EEXIST against the
+// one a previous run left behind.
+func setupPolicyRouting(outbound Outbound, family string) error {
+    if outbound.TableID == 0 {
+        return nil
+    }
+
+    // netlink.NewRule() leaves Mark unset (-1, "don't match on mark").
+    // Without a non-zero fwmark configured, FRA_FWMARK would be
+    // installed as 0, which matches unmarked packets — i.e. essentially
+    // all ordinary traffic — and routes it into this outbound's table.
+    // Refuse rather than silently installing a rule that swallows
+    // everything.
+    if outbound.FwMark == 0 {
+        return fmt.Errorf("outbound %s has table_id set but no fwmark configured; refusing to install an ip rule that would match unmarked traffic", outbound.Name)
+    }
+
+    for _, fam := range ruleFamilies(family) {
+        rule := netlink.NewRule()
+        rule.Table = outbound.TableID
+        rule.Mark = int(outbound.FwMark)
+        rule.Family = fam
+        rule.Priority = rulePriorityBase + outbound.TableID
+
+        _ = netlink.RuleDel(rule)
+        if err := netlink.RuleAdd(rule); err != nil {
+            return fmt.Errorf("error adding ip rule for table %d fwmark %d: %v", outbound.TableID, outbound.FwMark, err)
+        }
+    }
+
+    return nil
+}
+
+// setupPolicyRoutingForOutbounds programs policy routing for every
+// outbound that uses a dedicated routing table, not just a single
+// hardcoded one.
+func setupPolicyRoutingForOutbounds(outbounds map[string]Outbound, family string) error {
+    for _, outbound := range outbounds {
+        if err := setupPolicyRouting(outbound, family); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// ruleFamilies maps the family=ipv4|ipv6|both config value to the
+// netlink address families an `ip rule` needs to be installed for.
+func ruleFamilies(family string) []int {
+    switch family {
+    case "ipv4":
+        return []int{netlink.FAMILY_V4}
+    case "ipv6":
+        return []int{netlink.FAMILY_V6}
+    default:
+        return []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+    }
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/oschwald/maxminddb-golang"
+)
+
+// Rule types understood by the RuleEngine, matching the Clash rule DSL.
+const (
+    RuleIPCIDR        = "IP-CIDR"
+    RuleIPCIDR6       = "IP-CIDR6"
+    RuleGeoIP         = "GEOIP"
+    RuleDomainSuffix  = "DOMAIN-SUFFIX"
+    RuleDomain        = "DOMAIN"
+    RuleMatch         = "MATCH"
+)
+
+// Rule is a single entry of the rule DSL, e.g. "IP-CIDR,1.2.3.0/24,ss"
+// or "MATCH,direct".
+type Rule struct {
+    Type     string
+    Value    string
+    Outbound string
+}
+
+// RuleEngine evaluates destinations against an ordered list of rules and
+// dispatches them to the matching outbound.
+type RuleEngine struct {
+    rules     []Rule
+    outbounds map[string]Outbound
+    geoDB     *maxminddb.Reader
+
+    mu        sync.RWMutex
+    domainIPs map[string][]string
+}
+
+// NewRuleEngine loads a rule file and binds it to the given named
+// outbounds (e.g. "ss", "direct"). geoipDBPath is the MaxMind database
+// used to evaluate any GEOIP rules in the file; it's an error for the
+// file to contain a GEOIP rule without one, rather than silently
+// accepting a rule that can never match.
+func NewRuleEngine(path string, outbounds map[string]Outbound, geoipDBPath string) (*RuleEngine, error) {
+    rules, err := loadRules(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var hasGeoIPRule bool
+    for _, rule := range rules {
+        if _, ok := outbounds[rule.Outbound]; !ok {
+            return nil, fmt.Errorf("rule %s,%s,%s references unknown outbound %q", rule.Type, rule.Value, rule.Outbound, rule.Outbound)
+        }
+        if rule.Type == RuleGeoIP {
+            hasGeoIPRule = true
+        }
+    }
+
+    engine := &RuleEngine{
+        rules:     rules,
+        outbounds: outbounds,
+        domainIPs: make(map[string][]string),
+    }
+
+    if hasGeoIPRule {
+        if geoipDBPath == "" {
+            return nil, fmt.Errorf("rule file %s has a GEOIP rule but no geoip_db is configured", path)
+        }
+        db, err := maxminddb.Open(geoipDBPath)
+        if err != nil {
+            return nil, fmt.Errorf("error opening GeoIP database %s: %v", geoipDBPath, err)
+        }
+        engine.geoDB = db
+    }
+
+    return engine, nil
+}
+
+// loadRules parses a plain-text rule file, one rule per line in the form
+// "TYPE,VALUE,OUTBOUND" (or "MATCH,OUTBOUND"). Blank lines and lines
+// starting with "#" are ignored.
+func loadRules(path string) ([]Rule, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    var rules []Rule
+    scanner := bufio.NewScanner(file)
+
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        fields := strings.SplitN(line, ",", 3)
+        for i := range fields {
+            fields[i] = strings.TrimSpace(fields[i])
+        }
+
+        ruleType := strings.ToUpper(fields[0])
+
+        if ruleType == RuleMatch {
+            if len(fields) < 2 {
+                return nil, fmt.Errorf("malformed rule %q: MATCH requires an outbound", line)
+            }
+            rules = append(rules, Rule{Type: RuleMatch, Outbound: fields[1]})
+            continue
+        }
+
+        if len(fields) != 3 {
+            return nil, fmt.Errorf("malformed rule %q: expected TYPE,VALUE,OUTBOUND", line)
+        }
+
+        rules = append(rules, Rule{Type: ruleType, Value: fields[1], Outbound: fields[2]})
+    }
+
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+
+    return rules, nil
+}
+
+// Classify evaluates destination (an IP or CIDR literal) against the
+// rule set in order and returns the matching outbound. The second
+// return value is false if no rule matched.
+func (e *RuleEngine) Classify(destination string) (Outbound, bool) {
+    ip, ipNet, err := net.ParseCIDR(destination)
+    if err != nil {
+        ip = net.ParseIP(destination)
+    }
+
+    for _, rule := range e.rules {
+        switch rule.Type {
+        case RuleIPCIDR, RuleIPCIDR6:
+            _, ruleNet, err := net.ParseCIDR(rule.Value)
+            if err != nil {
+                continue
+            }
+            if ip != nil && ruleNet.Contains(ip) {
+                return e.outbounds[rule.Outbound], true
+            }
+            if ipNet != nil && ruleNet.Contains(ipNet.IP) {
+                return e.outbounds[rule.Outbound], true
+            }
+        case RuleGeoIP:
+            if e.geoDB == nil || ip == nil {
+                continue
+            }
+            var record geoipRecord
+            if err := e.geoDB.Lookup(ip, &record); err != nil {
+                continue
+            }
+            if record.Country.ISOCode == rule.Value {
+                return e.outbounds[rule.Outbound], true
+            }
+        case RuleMatch:
+            return e.outbounds[rule.Outbound], true
+        }
+    }
+
+    return Outbound{}, false
+}
+
+// InstallRules installs routes for every IP-CIDR/IP-CIDR6/GEOIP rule in
+// the engine: IP-CIDR/IP-CIDR6 rules contribute their own literal CIDR,
+// GEOIP rules contribute every network in the GeoIP database matching
+// their country. Each candidate destination is then run back through
+// Classify so that rule order still decides the outbound when more than
+// one rule could match it (e.g. a narrower IP-CIDR rule ahead of a
+// GEOIP rule for the same country).
+func (e *RuleEngine) InstallRules(gouroutinecount int) error {
+    seen := make(map[string]struct{})
+    var candidates []string
+
+    addCandidate := func(dest string) {
+        if _, ok := seen[dest]; ok {
+            return
+        }
+        seen[dest] = struct{}{}
+        candidates = append(candidates, dest)
+    }
+
+    for _, rule := range e.rules {
+        switch rule.Type {
+        case RuleIPCIDR, RuleIPCIDR6:
+            addCandidate(rule.Value)
+        case RuleGeoIP:
+            for _, network := range e.geoipNetworksForCountry(rule.Value) {
+                addCandidate(network)
+            }
+        }
+    }
+
+    buckets := make(map[string][]string)
+    for _, dest := range candidates {
+        outbound, ok := e.Classify(dest)
+        if !ok {
+            continue
+        }
+        buckets[outbound.Name] = append(buckets[outbound.Name], dest)
+    }
+
+    for name, dests := range buckets {
+        log.Printf("Installing %d rule-matched routes via outbound %s\n", len(dests), name)
+        addRoutesPool(dests, e.outbounds[name], routeProtocolRules, gouroutinecount)
+    }
+
+    return nil
+}
+
+// geoipNetworksForCountry walks the engine's GeoIP database and returns
+// every network whose country ISO code matches country.
+func (e *RuleEngine) geoipNetworksForCountry(country string) []string {
+    if e.geoDB == nil {
+        return nil
+    }
+
+    var networks []string
+    it := e.geoDB.Networks()
+    for it.Next() {
+        var record geoipRecord
+        subnet, err := it.Network(&record)
+        if err != nil {
+            log.Printf("\033[31mError reading GeoIP network: %v\033[0m\n", err)
+            continue
+        }
+        if record.Country.ISOCode == country {
+            networks = append(networks, subnet.String())
+        }
+    }
+    if err := it.Err(); err != nil {
+        log.Printf("\033[31mError walking GeoIP database: %v\033[0m\n", err)
+    }
+
+    return networks
+}
+
+// ResolveDomainRules resolves every DOMAIN/DOMAIN-SUFFIX rule's hostname
+// via the system resolver and installs a route for each address. If
+// refresh is non-zero, it keeps re-resolving on that interval for the
+// life of the process so that changing DNS answers stay reflected in
+// the routing table.
+func (e *RuleEngine) ResolveDomainRules(gouroutinecount int, refresh time.Duration) {
+    e.resolveDomainRulesOnce(gouroutinecount)
+
+    if refresh <= 0 {
+        return
+    }
+
+    go func() {
+        ticker := time.NewTicker(refresh)
+        defer ticker.Stop()
+        for range ticker.C {
+            e.resolveDomainRulesOnce(gouroutinecount)
+        }
+    }()
+}
+
+func (e *RuleEngine) resolveDomainRulesOnce(gouroutinecount int) {
+    resolver := net.DefaultResolver
+
+    for _, rule := range e.rules {
+        if rule.Type != RuleDomain && rule.Type != RuleDomainSuffix {
+            continue
+        }
+
+        outbound, ok := e.outbounds[rule.Outbound]
+        if !ok {
+            continue
+        }
+
+        addrs, err := resolver.LookupHost(context.Background(), rule.Value)
+        if err != nil {
+            log.Printf("\033[31mError resolving domain rule %s: %v\033[0m\n", rule.Value, err)
+            continue
+        }
+
+        e.mu.Lock()
+        previous := e.domainIPs[rule.Value]
+        e.domainIPs[rule.Value] = addrs
+        e.mu.Unlock()
+
+        if stale := staleAddrs(previous, addrs); len(stale) > 0 {
+            log.Printf("Domain rule %s no longer resolves to %v, withdrawing routes\n", rule.Value, stale)
+            deleteRoutes(stale, outbound, routeProtocolDomain)
+        }
+
+        addRoutesPool(addrs, outbound, routeProtocolDomain, gouroutinecount)
+    }
+}
+
+// staleAddrs returns the entries of previous that are no longer present
+// in current, i.e. the addresses a DOMAIN/DOMAIN-SUFFIX rule's routes
+// should be withdrawn for after a re-resolve.
+func staleAddrs(previous, current []string) []string {
+    currentSet := make(map[string]struct{}, len(current))
+    for _, addr := range current {
+        currentSet[addr] = struct{}{}
+    }
+
+    var stale []string
+    for _, addr := range previous {
+        if _, ok := currentSet[addr]; !ok {
+            stale = append(stale, addr)
+        }
+    }
+    return stale
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func writeRulesFile(t *testing.T, contents string) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "rules.conf")
+    if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+        t.Fatalf("error writing rules file: %v", err)
+    }
+    return path
+}
+
+func TestLoadRules(t *testing.T) {
+    tests := []struct {
+        name    string
+        input   string
+        want    []Rule
+        wantErr bool
+    }{
+        {
+            name: "mixed rule types, comments and blank lines ignored",
+            input: "" +
+                "# a comment\n" +
+                "\n" +
+                "IP-CIDR,10.0.0.0/8,direct\n" +
+                "IP-CIDR6,fd00::/8,direct\n" +
+                "GEOIP,CN,direct\n" +
+                "DOMAIN,example.com,ss\n" +
+                "DOMAIN-SUFFIX,example.org,ss\n" +
+                "MATCH,ss\n",
+            want: []Rule{
+                {Type: RuleIPCIDR, Value: "10.0.0.0/8", Outbound: "direct"},
+                {Type: RuleIPCIDR6, Value: "fd00::/8", Outbound: "direct"},
+                {Type: RuleGeoIP, Value: "CN", Outbound: "direct"},
+                {Type: RuleDomain, Value: "example.com", Outbound: "ss"},
+                {Type: RuleDomainSuffix, Value: "example.org", Outbound: "ss"},
+                {Type: RuleMatch, Outbound: "ss"},
+            },
+        },
+        {
+            name:  "lowercase rule type is upper-cased",
+            input: "ip-cidr,1.2.3.0/24,ss\n",
+            want:  []Rule{{Type: RuleIPCIDR, Value: "1.2.3.0/24", Outbound: "ss"}},
+        },
+        {
+            name:    "MATCH without an outbound is malformed",
+            input:   "MATCH\n",
+            wantErr: true,
+        },
+        {
+            name:    "IP-CIDR without an outbound is malformed",
+            input:   "IP-CIDR,1.2.3.0/24\n",
+            wantErr: true,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            path := writeRulesFile(t, tt.input)
+            got, err := loadRules(path)
+            if tt.wantErr {
+                if err == nil {
+                    t.Fatalf("loadRules(%q): expected an error, got none", tt.input)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("loadRules(%q): unexpected error: %v", tt.input, err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Fatalf("loadRules(%q) = %#v, want %#v", tt.input, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestStaleAddrs(t *testing.T) {
+    tests := []struct {
+        name     string
+        previous []string
+        current  []string
+        want     []string
+    }{
+        {
+            name:     "no previous resolution",
+            previous: nil,
+            current:  []string{"1.2.3.4"},
+            want:     nil,
+        },
+        {
+            name:     "unchanged answer",
+            previous: []string{"1.2.3.4", "1.2.3.5"},
+            current:  []string{"1.2.3.4", "1.2.3.5"},
+            want:     nil,
+        },
+        {
+            name:     "one address dropped",
+            previous: []string{"1.2.3.4", "1.2.3.5"},
+            current:  []string{"1.2.3.4"},
+            want:     []string{"1.2.3.5"},
+        },
+        {
+            name:     "entire answer replaced",
+            previous: []string{"1.2.3.4"},
+            current:  []string{"5.6.7.8"},
+            want:     []string{"1.2.3.4"},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := staleAddrs(tt.previous, tt.current)
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Fatalf("staleAddrs(%v, %v) = %v, want %v", tt.previous, tt.current, got, tt.want)
+            }
+        })
+    }
+}
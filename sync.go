@@ -0,0 +1,357 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/fsnotify/fsnotify"
+    "github.com/vishvananda/netlink"
+)
+
+// sourcesFileName is the special file that, instead of listing
+// destinations directly, lists URLs to fetch destinations from.
+const sourcesFileName = "sources.json"
+
+// canonicalDestination normalizes a destination to its CIDR string so
+// the same address always produces the same set key regardless of how
+// it was spelled in the source file.
+func canonicalDestination(destination string) (string, error) {
+    _, ipNet, err := parseDestination(destination)
+    if err != nil {
+        return "", err
+    }
+    return ipNet.String(), nil
+}
+
+// parseDestinationList parses the body of a route list, accepting
+// either a JSON array of destinations or a plain-text file with one
+// CIDR/IP per line (blank lines and "#" comments ignored). This is the
+// format understood for both local files and remote sources fetched
+// via fetchSource.
+func parseDestinationList(data []byte) ([]string, error) {
+    trimmed := bytes.TrimSpace(data)
+    if len(trimmed) > 0 && trimmed[0] == '[' {
+        var destinations []string
+        if err := json.Unmarshal(trimmed, &destinations); err != nil {
+            return nil, err
+        }
+        return destinations, nil
+    }
+
+    var destinations []string
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        destinations = append(destinations, line)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+
+    return destinations, nil
+}
+
+// collectDesiredRoutes walks every JSON file in dir and returns the set
+// of destinations it lists, canonicalized so it can be diffed against
+// what's actually installed in the kernel. A sources.json file is
+// treated specially: it lists URLs, which are fetched through the
+// content-addressable cache and parsed the same way as a local file.
+func collectDesiredRoutes(dir string) (map[string]struct{}, error) {
+    desired := make(map[string]struct{})
+
+    if _, err := os.Stat(dir); os.IsNotExist(err) {
+        return desired, nil
+    }
+
+    var jsonFiles, sourceFiles []string
+    err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        if info.IsDir() || filepath.Ext(path) != ".json" {
+            return nil
+        }
+        if filepath.Base(path) == sourcesFileName {
+            sourceFiles = append(sourceFiles, path)
+        } else {
+            jsonFiles = append(jsonFiles, path)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, fmt.Errorf("error reading folder %s: %v", dir, err)
+    }
+
+    for _, path := range jsonFiles {
+        data, err := ioutil.ReadFile(path)
+        if err != nil {
+            log.Printf("\033[31mError reading file %s: %v\033[0m\n", path, err)
+            continue
+        }
+
+        destinations, err := parseDestinationList(data)
+        if err != nil {
+            log.Printf("\033[31mError parsing %s: %v\033[0m\n", path, err)
+            continue
+        }
+
+        addDestinations(desired, destinations, path)
+    }
+
+    for _, path := range sourceFiles {
+        collectSourceDestinations(path, desired)
+    }
+
+    return desired, nil
+}
+
+// addDestinations canonicalizes and merges destinations into desired,
+// logging (and skipping) any that don't parse.
+func addDestinations(desired map[string]struct{}, destinations []string, origin string) {
+    for _, dest := range destinations {
+        canon, err := canonicalDestination(dest)
+        if err != nil {
+            log.Printf("\033[31mError parsing destination %s in %s: %v\033[0m\n", dest, origin, err)
+            continue
+        }
+        desired[canon] = struct{}{}
+    }
+}
+
+// collectSourceDestinations reads a sources.json file's list of URLs,
+// fetches each through the content-addressable cache, and merges the
+// destinations it lists into desired.
+func collectSourceDestinations(path string, desired map[string]struct{}) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        log.Printf("\033[31mError reading file %s: %v\033[0m\n", path, err)
+        return
+    }
+
+    var urls []string
+    if err := json.Unmarshal(data, &urls); err != nil {
+        log.Printf("\033[31mError parsing %s: %v\033[0m\n", path, err)
+        return
+    }
+
+    for _, url := range urls {
+        cachedPath, err := fetchSource(url)
+        if err != nil {
+            log.Printf("\033[31mError fetching source %s: %v\033[0m\n", url, err)
+            continue
+        }
+
+        body, err := ioutil.ReadFile(cachedPath)
+        if err != nil {
+            log.Printf("\033[31mError reading cached copy of %s: %v\033[0m\n", url, err)
+            continue
+        }
+
+        destinations, err := parseDestinationList(body)
+        if err != nil {
+            log.Printf("\033[31mError parsing source %s: %v\033[0m\n", url, err)
+            continue
+        }
+
+        addDestinations(desired, destinations, url)
+    }
+}
+
+// collectInstalledRoutes returns the set of destinations currently
+// installed in the kernel for the given outbound's interface and
+// routing table, restricted to routes tagged with protocol — i.e. the
+// ones a specific producer (see the routeProtocol* constants) added
+// itself, never another producer's or the kernel's own.
+func collectInstalledRoutes(outbound Outbound, protocol int) (map[string]struct{}, error) {
+    installed := make(map[string]struct{})
+
+    iface, err := netlink.LinkByName(outbound.Interface)
+    if err != nil {
+        return nil, fmt.Errorf("error reading interface %s: %v", outbound.Interface, err)
+    }
+
+    routes, err := routeListForOutbound(iface, outbound, protocol)
+    if err != nil {
+        return nil, fmt.Errorf("error listing routes on %s: %v", outbound.Interface, err)
+    }
+
+    for _, route := range routes {
+        if route.Dst == nil {
+            continue
+        }
+        installed[route.Dst.String()] = struct{}{}
+    }
+
+    return installed, nil
+}
+
+// routeListForOutbound lists the routes on iface that were installed
+// with the given protocol tag (see addRoute and the routeProtocol*
+// constants), restricted to outbound's routing table when it uses a
+// dedicated one (TableID != 0). Filtering by protocol is what keeps
+// this from ever seeing the kernel's own routes (default route,
+// connected subnet, ...) on outbounds that share the main table, or
+// another producer's routes on the same interface/table.
+func routeListForOutbound(iface netlink.Link, outbound Outbound, protocol int) ([]netlink.Route, error) {
+    filter := &netlink.Route{LinkIndex: iface.Attrs().Index, Protocol: netlink.RouteProtocol(protocol)}
+    mask := netlink.RT_FILTER_OIF | netlink.RT_FILTER_PROTOCOL
+
+    if outbound.TableID != 0 {
+        filter.Table = outbound.TableID
+        mask |= netlink.RT_FILTER_TABLE
+    }
+
+    return netlink.RouteListFiltered(netlink.FAMILY_ALL, filter, mask)
+}
+
+// diffRoutes returns the destinations present in desired but missing
+// from installed (toAdd), and the destinations present in installed
+// but no longer desired (toDelete).
+func diffRoutes(desired, installed map[string]struct{}) (toAdd, toDelete []string) {
+    for dest := range desired {
+        if _, ok := installed[dest]; !ok {
+            toAdd = append(toAdd, dest)
+        }
+    }
+    for dest := range installed {
+        if _, ok := desired[dest]; !ok {
+            toDelete = append(toDelete, dest)
+        }
+    }
+    return toAdd, toDelete
+}
+
+// deleteRoutes removes a set of canonical CIDR destinations tagged with
+// protocol from the kernel for the given outbound's interface.
+func deleteRoutes(destinations []string, outbound Outbound, protocol int) {
+    iface, err := netlink.LinkByName(outbound.Interface)
+    if err != nil {
+        log.Printf("\033[31mError reading interface %s: %v\033[0m\n", outbound.Interface, err)
+        return
+    }
+
+    for _, dest := range destinations {
+        _, ipNet, err := parseDestination(dest)
+        if err != nil {
+            log.Printf("\033[31mError parsing destination %s: %v\033[0m\n", dest, err)
+            continue
+        }
+
+        route := &netlink.Route{Dst: ipNet, LinkIndex: iface.Attrs().Index, Table: outbound.TableID, Protocol: netlink.RouteProtocol(protocol)}
+        if err := netlink.RouteDel(route); err != nil {
+            log.Printf("\033[31mError deleting route %s via %s dev %s: %v\033[0m\n", dest, outbound.Gateway, outbound.Interface, err)
+        }
+    }
+}
+
+// reconcileDir diffs dir's desired destination set against the routes
+// actually installed for outbound and applies just the delta, so
+// restarts and config edits are idempotent and cheap instead of
+// re-attempting every route on every run. It only ever looks at and
+// touches routes tagged routeProtocolSync — the ones a directory sync
+// itself produced — so it can never delete a GeoIP, rule-engine, domain,
+// or ad-hoc API route living on the same interface/table.
+func reconcileDir(dir string, outbound Outbound, gouroutinecount int) error {
+    desired, err := collectDesiredRoutes(dir)
+    if err != nil {
+        return err
+    }
+
+    installed, err := collectInstalledRoutes(outbound, routeProtocolSync)
+    if err != nil {
+        return err
+    }
+
+    toAdd, toDelete := diffRoutes(desired, installed)
+    log.Printf("Reconciling %s: %d to add, %d to delete\n", dir, len(toAdd), len(toDelete))
+
+    addRoutesPool(toAdd, outbound, routeProtocolSync, gouroutinecount)
+    deleteRoutes(toDelete, outbound, routeProtocolSync)
+
+    return nil
+}
+
+// watchDir reconciles dir against outbound once, then watches it with
+// fsnotify and re-reconciles on every change so config edits take
+// effect without a restart and without re-adding routes that are
+// already installed. If refresh is non-zero, it also re-reconciles on
+// that interval regardless of local file events, which is what picks
+// up changes to sources.json's remote lists.
+func watchDir(dir string, outbound Outbound, gouroutinecount int, refresh time.Duration) error {
+    if err := reconcileDir(dir, outbound, gouroutinecount); err != nil {
+        return err
+    }
+
+    if _, err := os.Stat(dir); os.IsNotExist(err) {
+        log.Printf("Directory %s does not exist — not watching\n", dir)
+        return nil
+    }
+
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return fmt.Errorf("error creating watcher for %s: %v", dir, err)
+    }
+
+    if err := watcher.Add(dir); err != nil {
+        watcher.Close()
+        return fmt.Errorf("error watching %s: %v", dir, err)
+    }
+
+    go func() {
+        defer watcher.Close()
+
+        // Coalesce bursts of events (e.g. an editor's save-as-rename)
+        // into a single reconcile pass.
+        debounce := time.NewTimer(24 * time.Hour)
+        if !debounce.Stop() {
+            <-debounce.C
+        }
+
+        var refreshTicker *time.Ticker
+        var refreshChan <-chan time.Time
+        if refresh > 0 {
+            refreshTicker = time.NewTicker(refresh)
+            refreshChan = refreshTicker.C
+            defer refreshTicker.Stop()
+        }
+
+        for {
+            select {
+            case event, ok := <-watcher.Events:
+                if !ok {
+                    return
+                }
+                if filepath.Ext(event.Name) != ".json" {
+                    continue
+                }
+                debounce.Reset(250 * time.Millisecond)
+            case <-debounce.C:
+                if err := reconcileDir(dir, outbound, gouroutinecount); err != nil {
+                    log.Printf("\033[31mError reconciling %s: %v\033[0m\n", dir, err)
+                }
+            case <-refreshChan:
+                if err := reconcileDir(dir, outbound, gouroutinecount); err != nil {
+                    log.Printf("\033[31mError refreshing sources in %s: %v\033[0m\n", dir, err)
+                }
+            case err, ok := <-watcher.Errors:
+                if !ok {
+                    return
+                }
+                log.Printf("\033[31mWatcher error on %s: %v\033[0m\n", dir, err)
+            }
+        }
+    }()
+
+    return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "testing"
+)
+
+func TestParseDestinationList(t *testing.T) {
+    tests := []struct {
+        name    string
+        input   string
+        want    []string
+        wantErr bool
+    }{
+        {
+            name:  "json array",
+            input: `["1.2.3.0/24", "4.5.6.7"]`,
+            want:  []string{"1.2.3.0/24", "4.5.6.7"},
+        },
+        {
+            name:  "plain text with blanks and comments",
+            input: "1.2.3.0/24\n\n# a comment\n4.5.6.7\n",
+            want:  []string{"1.2.3.0/24", "4.5.6.7"},
+        },
+        {
+            name:    "malformed json array",
+            input:   `["1.2.3.0/24"`,
+            wantErr: true,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := parseDestinationList([]byte(tt.input))
+            if tt.wantErr {
+                if err == nil {
+                    t.Fatalf("parseDestinationList(%q): expected an error, got none", tt.input)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("parseDestinationList(%q): unexpected error: %v", tt.input, err)
+            }
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Fatalf("parseDestinationList(%q) = %v, want %v", tt.input, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestCanonicalDestination(t *testing.T) {
+    tests := []struct {
+        name        string
+        destination string
+        want        string
+        wantErr     bool
+    }{
+        {name: "already a cidr", destination: "1.2.3.0/24", want: "1.2.3.0/24"},
+        {name: "bare ipv4 widened to /32", destination: "1.2.3.4", want: "1.2.3.4/32"},
+        {name: "bare ipv6 widened to /128", destination: "fd00::1", want: "fd00::1/128"},
+        {name: "unparseable", destination: "not-an-ip", wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := canonicalDestination(tt.destination)
+            if tt.wantErr {
+                if err == nil {
+                    t.Fatalf("canonicalDestination(%q): expected an error, got none", tt.destination)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("canonicalDestination(%q): unexpected error: %v", tt.destination, err)
+            }
+            if got != tt.want {
+                t.Fatalf("canonicalDestination(%q) = %q, want %q", tt.destination, got, tt.want)
+            }
+        })
+    }
+}
+
+func TestDiffRoutes(t *testing.T) {
+    tests := []struct {
+        name       string
+        desired    map[string]struct{}
+        installed  map[string]struct{}
+        wantAdd    []string
+        wantDelete []string
+    }{
+        {
+            name:      "nothing desired or installed",
+            desired:   map[string]struct{}{},
+            installed: map[string]struct{}{},
+        },
+        {
+            name:    "everything desired is new",
+            desired: map[string]struct{}{"1.2.3.0/24": {}, "4.5.6.0/24": {}},
+            installed: map[string]struct{}{},
+            wantAdd: []string{"1.2.3.0/24", "4.5.6.0/24"},
+        },
+        {
+            name:      "everything installed is stale",
+            desired:   map[string]struct{}{},
+            installed: map[string]struct{}{"1.2.3.0/24": {}, "4.5.6.0/24": {}},
+            wantDelete: []string{"1.2.3.0/24", "4.5.6.0/24"},
+        },
+        {
+            name:       "mixed: one kept, one added, one deleted",
+            desired:    map[string]struct{}{"1.2.3.0/24": {}, "7.8.9.0/24": {}},
+            installed:  map[string]struct{}{"1.2.3.0/24": {}, "4.5.6.0/24": {}},
+            wantAdd:    []string{"7.8.9.0/24"},
+            wantDelete: []string{"4.5.6.0/24"},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            gotAdd, gotDelete := diffRoutes(tt.desired, tt.installed)
+            sort.Strings(gotAdd)
+            sort.Strings(gotDelete)
+            sort.Strings(tt.wantAdd)
+            sort.Strings(tt.wantDelete)
+            if !reflect.DeepEqual(gotAdd, tt.wantAdd) {
+                t.Fatalf("diffRoutes toAdd = %v, want %v", gotAdd, tt.wantAdd)
+            }
+            if !reflect.DeepEqual(gotDelete, tt.wantDelete) {
+                t.Fatalf("diffRoutes toDelete = %v, want %v", gotDelete, tt.wantDelete)
+            }
+        })
+    }
+}
+
+func TestCollectDesiredRoutes(t *testing.T) {
+    dir := t.TempDir()
+
+    if err := os.WriteFile(filepath.Join(dir, "a.json"), []byte(`["1.2.3.0/24", "4.5.6.7"]`), 0o644); err != nil {
+        t.Fatalf("error writing a.json: %v", err)
+    }
+    if err := os.WriteFile(filepath.Join(dir, "b.json"), []byte("8.9.10.0/24\n"), 0o644); err != nil {
+        t.Fatalf("error writing b.json: %v", err)
+    }
+    // Non-.json files are ignored.
+    if err := os.WriteFile(filepath.Join(dir, "ignored.txt"), []byte("11.12.13.0/24\n"), 0o644); err != nil {
+        t.Fatalf("error writing ignored.txt: %v", err)
+    }
+
+    got, err := collectDesiredRoutes(dir)
+    if err != nil {
+        t.Fatalf("collectDesiredRoutes: unexpected error: %v", err)
+    }
+
+    want := map[string]struct{}{
+        "1.2.3.0/24": {},
+        "4.5.6.7/32": {},
+        "8.9.10.0/24": {},
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("collectDesiredRoutes = %v, want %v", got, want)
+    }
+}
+
+func TestCollectDesiredRoutesMissingDir(t *testing.T) {
+    got, err := collectDesiredRoutes(filepath.Join(t.TempDir(), "does-not-exist"))
+    if err != nil {
+        t.Fatalf("collectDesiredRoutes: unexpected error: %v", err)
+    }
+    if len(got) != 0 {
+        t.Fatalf("collectDesiredRoutes on a missing dir = %v, want empty", got)
+    }
+}